@@ -0,0 +1,85 @@
+/*
+ * Minio Cloud Storage, (C) 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"net/http"
+	"time"
+)
+
+// listLocks aggregates ListLocksReply.Locks from every lock server
+// started locally, then from every remote peer in nodes, into a
+// single cluster-wide snapshot. Errors reaching an individual peer
+// are not fatal - that peer's locks are simply missing from the
+// result - since the whole point of this endpoint is to help an
+// operator when part of the cluster is already unhealthy.
+//
+// Local servers are queried directly via listLocksMatching rather
+// than through the authenticated ListLocks RPC: this call runs
+// in-process inside an already admin-authenticated HTTP request, and
+// args here never carries an RPC auth token, so going through
+// ListLocks would reject every local lock server and silently drop
+// all local locks from the result.
+func listLocks(nodes []string, args ListLocksArgs) []lockEntryInfo {
+	var locks []lockEntryInfo
+
+	for _, locker := range globalLockServers {
+		locks = append(locks, locker.listLocksMatching(&args)...)
+	}
+
+	for _, node := range nodes {
+		client, err := newAuthRPCClient(node, lockRPCPath)
+		if err != nil {
+			continue
+		}
+		var reply ListLocksReply
+		if err = client.Call("Lock.ListLocks", &args, &reply); err != nil {
+			continue
+		}
+		locks = append(locks, reply.Locks...)
+	}
+
+	return locks
+}
+
+// ListLocksHandler - GET /?lock&prefix=&older-than=&writer-only=&node=
+//
+// Returns a JSON snapshot of locks currently held across the cluster,
+// filtered by the given query parameters. This gives operators a way
+// to diagnose stuck locks (mc admin locks list) before resorting to
+// ForceUnlock (mc admin locks clear).
+func (a adminAPIHandlers) ListLocksHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	args := ListLocksArgs{
+		Prefix:     query.Get("prefix"),
+		WriterOnly: query.Get("writer-only") == "true",
+		Node:       query.Get("node"),
+	}
+	if olderThan := query.Get("older-than"); olderThan != "" {
+		duration, err := time.ParseDuration(olderThan)
+		if err != nil {
+			writeErrorResponse(w, ErrInvalidDuration, r.URL)
+			return
+		}
+		args.Duration = duration
+	}
+
+	locks := listLocks(remoteLockRPCNodes(globalSrvCmdConfig), args)
+
+	writeSuccessResponseJSON(w, locks)
+}
@@ -0,0 +1,624 @@
+/*
+ * Minio Cloud Storage, (C) 2016, 2017 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+const (
+	// Lock rpc server endpoint.
+	lockRPCPath = "/lock"
+
+	// Lock maintenance interval, it is the interval at which the
+	// reaper goroutine wakes up and evicts expired lock entries.
+	lockMaintenanceInterval = 30 * time.Second
+
+	// Default amount of time a LockBlocking caller waits for a queued
+	// write lock before giving up, used when the caller did not supply
+	// its own Deadline.
+	lockDefaultWaitDeadline = 5 * time.Second
+)
+
+// LockArgs is minimal required values for any dsync compatible lock
+// operation along with authentication.
+type LockArgs struct {
+	AuthRPCArgs
+
+	// LockArgs.Resource contains the resource to be locked/unlocked.
+	LockArgs dsync.LockArgs
+
+	// TTL is how long the requester wants this particular lock to be
+	// held before the server is free to reclaim it. Zero (the default
+	// for callers that never opt in) means the lock never expires on
+	// its own and is only released by an explicit Unlock/RUnlock/
+	// ForceUnlock - the reaper will not touch it. Callers that do ask
+	// for a TTL (e.g. multipart uploads) must call Renew before it
+	// elapses or the reaper reclaims the lock.
+	TTL time.Duration
+
+	// Deadline bounds how long a LockBlocking call waits in the write
+	// queue before giving up. Zero means the server picks
+	// lockDefaultWaitDeadline.
+	Deadline time.Duration
+}
+
+// newLockArgs constructs LockArgs from dsync.LockArgs; it does not set
+// the request's authentication fields, which the caller fills in via
+// SetAuthToken / SetRequestTime.
+// newLockArgs builds a LockArgs requesting the given per-lock TTL.
+// Zero means the resulting lock never expires on its own; see the TTL
+// field's doc comment for what a non-zero value obligates the caller
+// to do.
+func newLockArgs(args dsync.LockArgs, ttl time.Duration) LockArgs {
+	return LockArgs{
+		LockArgs: args,
+		TTL:      ttl,
+	}
+}
+
+// deadline returns the wait deadline to apply for a LockBlocking call,
+// substituting the default when the caller did not specify one.
+func (l *LockArgs) deadline() time.Duration {
+	if l.Deadline <= 0 {
+		return lockDefaultWaitDeadline
+	}
+	return l.Deadline
+}
+
+// lockRequesterInfo stores various info from the client for each lock
+// that is requested.
+type lockRequesterInfo struct {
+	writer        bool      // Bool whether this is a write or read lock.
+	node          string    // Network address of client claiming lock.
+	rpcPath       string    // RPC path of client claiming lock.
+	uid           string    // UID to uniquely identify request of client.
+	timestamp     time.Time // Timestamp set at the time of initialization.
+	timeLastCheck time.Time // Timestamp for last check of validity of lock.
+	expiresAt     time.Time // Deadline after which the reaper may evict this entry.
+}
+
+// isWriteLock returns whether the lock is a write or read lock.
+func isWriteLock(lri []lockRequesterInfo) bool {
+	return len(lri) == 1 && lri[0].writer
+}
+
+// lockWaiter represents a write lock request parked on a resource's
+// FIFO queue by LockBlocking, waiting for the resource to become free.
+type lockWaiter struct {
+	uid     string
+	node    string
+	rpcPath string
+	ttl     time.Duration
+	granted chan struct{}
+}
+
+// lockServer is type for RPC handlers, it holds the state of all
+// locks currently granted for resources local to this node.
+type lockServer struct {
+	AuthRPCServer
+	rpcPath string
+	mutex   sync.Mutex
+	lockMap map[string][]lockRequesterInfo
+
+	// writeWaiters holds, per resource, the write locks queued by
+	// LockBlocking in arrival order. Its presence for a resource also
+	// signals RLock to defer new readers so a queued writer is not
+	// starved by a steady stream of readers.
+	writeWaiters map[string][]*lockWaiter
+}
+
+// newLockRequesterInfo constructs a lockRequesterInfo from an
+// incoming request, stamping it with the current time. expiresAt is
+// left zero - meaning the lock never expires on its own - unless the
+// caller opted into a TTL.
+func newLockRequesterInfo(args *LockArgs, writer bool) lockRequesterInfo {
+	now := UTCNow()
+	info := lockRequesterInfo{
+		writer:        writer,
+		node:          args.LockArgs.ServerAddr,
+		rpcPath:       args.LockArgs.ServiceEndpoint,
+		uid:           args.LockArgs.UID,
+		timestamp:     now,
+		timeLastCheck: now,
+	}
+	if args.TTL > 0 {
+		info.expiresAt = now.Add(args.TTL)
+	}
+	return info
+}
+
+// removeEntry either, based on the uid of the lock message, removes
+// a single entry from the slice, or the whole entry if the slice
+// only contains one element - in the case of a write lock.
+func removeEntry(lri []lockRequesterInfo, uid string) ([]lockRequesterInfo, bool) {
+	for index, entry := range lri {
+		if entry.uid == uid {
+			return append(lri[:index], lri[index+1:]...), true
+		}
+	}
+	return lri, false
+}
+
+// Lock - rpc handler for (single) write lock operation.
+func (l *lockServer) Lock(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, isLockTaken := l.lockMap[args.LockArgs.Resource]
+	*reply = !isLockTaken
+	if !isLockTaken {
+		l.lockMap[args.LockArgs.Resource] = []lockRequesterInfo{
+			newLockRequesterInfo(args, true),
+		}
+	}
+	return nil
+}
+
+// Unlock - rpc handler for (single) write unlock operation.
+func (l *lockServer) Unlock(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	*reply = false
+	lri, ok := l.lockMap[args.LockArgs.Resource]
+	if !ok || !isWriteLock(lri) {
+		return fmt.Errorf("Unlock unable to find corresponding lock for uid: %s", args.LockArgs.UID)
+	}
+	if lri[0].uid != args.LockArgs.UID {
+		return fmt.Errorf("Unlock unable to find corresponding lock for uid: %s", args.LockArgs.UID)
+	}
+	delete(l.lockMap, args.LockArgs.Resource)
+	l.grantNextWriterLocked(args.LockArgs.Resource)
+	*reply = true
+	return nil
+}
+
+// RLock - rpc handler for read lock operation. New read locks are
+// deferred (rejected, for the client to retry) whenever a writer is
+// already queued for the resource via LockBlocking, so a steady
+// stream of readers cannot starve a waiting writer.
+func (l *lockServer) RLock(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.writeWaiters[args.LockArgs.Resource]) > 0 {
+		*reply = false
+		return nil
+	}
+	lri, ok := l.lockMap[args.LockArgs.Resource]
+	*reply = !ok || !isWriteLock(lri)
+	if *reply {
+		l.lockMap[args.LockArgs.Resource] = append(lri, newLockRequesterInfo(args, false))
+	}
+	return nil
+}
+
+// RUnlock - rpc handler for read unlock operation.
+func (l *lockServer) RUnlock(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	*reply = false
+	lri, ok := l.lockMap[args.LockArgs.Resource]
+	if !ok || isWriteLock(lri) {
+		return fmt.Errorf("RUnlock unable to find corresponding read lock for uid: %s", args.LockArgs.UID)
+	}
+	lri, removed := removeEntry(lri, args.LockArgs.UID)
+	if !removed {
+		return fmt.Errorf("RUnlock unable to find corresponding read lock for uid: %s", args.LockArgs.UID)
+	}
+	if len(lri) == 0 {
+		delete(l.lockMap, args.LockArgs.Resource)
+		l.grantNextWriterLocked(args.LockArgs.Resource)
+	} else {
+		l.lockMap[args.LockArgs.Resource] = lri
+	}
+	*reply = true
+	return nil
+}
+
+// ForceUnlock - rpc handler for force unlock operation, used by
+// operators to break a stuck lock regardless of who holds it.
+func (l *lockServer) ForceUnlock(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	if args.LockArgs.UID != "" {
+		return fmt.Errorf("ForceUnlock called with non-empty UID: %s", args.LockArgs.UID)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.lockMap, args.LockArgs.Resource)
+	l.grantNextWriterLocked(args.LockArgs.Resource)
+	*reply = true
+	return nil
+}
+
+// LockBlocking - rpc handler for a write lock request that waits
+// rather than failing immediately: if the resource is free and no
+// writer is already queued, it grants the lock right away; otherwise
+// it joins the resource's FIFO write queue and blocks until granted
+// by Unlock/RUnlock/ForceUnlock/reapExpired freeing the resource, or
+// until the caller-supplied Deadline elapses.
+func (l *lockServer) LockBlocking(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	_, isLockTaken := l.lockMap[args.LockArgs.Resource]
+	if !isLockTaken && len(l.writeWaiters[args.LockArgs.Resource]) == 0 {
+		l.lockMap[args.LockArgs.Resource] = []lockRequesterInfo{newLockRequesterInfo(args, true)}
+		l.mutex.Unlock()
+		*reply = true
+		return nil
+	}
+
+	waiter := &lockWaiter{
+		uid:     args.LockArgs.UID,
+		node:    args.LockArgs.ServerAddr,
+		rpcPath: args.LockArgs.ServiceEndpoint,
+		ttl:     args.TTL,
+		granted: make(chan struct{}),
+	}
+	if l.writeWaiters == nil {
+		l.writeWaiters = make(map[string][]*lockWaiter)
+	}
+	l.writeWaiters[args.LockArgs.Resource] = append(l.writeWaiters[args.LockArgs.Resource], waiter)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(args.deadline())
+	defer timer.Stop()
+	select {
+	case <-waiter.granted:
+		*reply = true
+		return nil
+	case <-timer.C:
+		l.mutex.Lock()
+		removedBeforeGrant := l.cancelWaiterLocked(args.LockArgs.Resource, waiter.uid)
+		l.mutex.Unlock()
+		if !removedBeforeGrant {
+			// The waiter was already gone from the queue by the time
+			// we got here, but that can mean either of two things:
+			// grantNextWriterLocked popped it and closed waiter.granted
+			// (an actual last-instant grant), or CancelWait already
+			// removed it on the caller's behalf (cancelWaiterLocked
+			// never closes the channel). Tell the two apart with a
+			// non-blocking read instead of assuming a grant and
+			// blocking forever on a channel CancelWait will never
+			// close.
+			select {
+			case <-waiter.granted:
+				*reply = true
+				return nil
+			default:
+				*reply = false
+				return nil
+			}
+		}
+		*reply = false
+		return nil
+	}
+}
+
+// CancelWait - rpc handler allowing a caller blocked in LockBlocking
+// to drop its queued write request, e.g. once it has given up waiting
+// locally. Returns true if a queued waiter for uid was found and
+// removed; it has no effect on a lock that has already been granted.
+func (l *lockServer) CancelWait(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	*reply = l.cancelWaiterLocked(args.LockArgs.Resource, args.LockArgs.UID)
+	return nil
+}
+
+// cancelWaiterLocked removes the waiter for uid from resource's write
+// queue, if present. Callers must hold l.mutex.
+func (l *lockServer) cancelWaiterLocked(resource, uid string) bool {
+	waiters := l.writeWaiters[resource]
+	for i, w := range waiters {
+		if w.uid != uid {
+			continue
+		}
+		l.writeWaiters[resource] = append(waiters[:i], waiters[i+1:]...)
+		if len(l.writeWaiters[resource]) == 0 {
+			delete(l.writeWaiters, resource)
+		}
+		return true
+	}
+	return false
+}
+
+// grantNextWriterLocked, called whenever resource becomes free, pops
+// the next queued writer (if any) off the FIFO queue and grants it
+// the write lock. Callers must hold l.mutex and must have already
+// ensured resource has no current holder.
+func (l *lockServer) grantNextWriterLocked(resource string) {
+	waiters := l.writeWaiters[resource]
+	if len(waiters) == 0 {
+		return
+	}
+	w := waiters[0]
+	l.writeWaiters[resource] = waiters[1:]
+	if len(l.writeWaiters[resource]) == 0 {
+		delete(l.writeWaiters, resource)
+	}
+	now := UTCNow()
+	entry := lockRequesterInfo{
+		writer:        true,
+		node:          w.node,
+		rpcPath:       w.rpcPath,
+		uid:           w.uid,
+		timestamp:     now,
+		timeLastCheck: now,
+	}
+	if w.ttl > 0 {
+		entry.expiresAt = now.Add(w.ttl)
+	}
+	l.lockMap[resource] = []lockRequesterInfo{entry}
+	close(w.granted)
+}
+
+// Renew - rpc handler that refreshes the lease of a previously
+// granted lock, pushing its expiresAt deadline to now plus the TTL
+// carried on this Renew call (a Renew without a TTL leaves expiresAt
+// unchanged). Long lived
+// holders call this periodically; once they stop, the reaper
+// reclaims the entry once its lease elapses.
+func (l *lockServer) Renew(args *LockArgs, reply *bool) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	*reply = false
+	lri, ok := l.lockMap[args.LockArgs.Resource]
+	if !ok {
+		return fmt.Errorf("Renew unable to find corresponding lock for uid: %s", args.LockArgs.UID)
+	}
+	for i := range lri {
+		if lri[i].uid != args.LockArgs.UID {
+			continue
+		}
+		now := UTCNow()
+		lri[i].timeLastCheck = now
+		if args.TTL > 0 {
+			lri[i].expiresAt = now.Add(args.TTL)
+		}
+		// A Renew with no TTL of its own (args.TTL == 0) just refreshes
+		// timeLastCheck and leaves the existing expiresAt - including a
+		// zero one, for a lock that was never leased - as is: zeroing
+		// it here would turn a renewal into an accidental unleasing.
+		*reply = true
+		return nil
+	}
+	return fmt.Errorf("Renew unable to find corresponding lock for uid: %s", args.LockArgs.UID)
+}
+
+// reapExpired evicts every lockRequesterInfo that opted into a TTL
+// and whose lease has passed its expiresAt deadline; locks with a
+// zero expiresAt (no TTL requested) are never touched. It is the
+// replacement for the old poll-based Expired handshake: instead of
+// clients asking "is my lock still valid?", the server proactively
+// drops dead locks on its own schedule.
+func (l *lockServer) reapExpired() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := UTCNow()
+	var freed []string
+	for resource, lri := range l.lockMap {
+		var kept []lockRequesterInfo
+		for _, entry := range lri {
+			if entry.expiresAt.IsZero() || entry.expiresAt.After(now) {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == 0 {
+			delete(l.lockMap, resource)
+			freed = append(freed, resource)
+		} else {
+			l.lockMap[resource] = kept
+		}
+	}
+	// Grant queued writers only after the eviction pass above has
+	// finished, so we never mutate l.lockMap while ranging over it.
+	for _, resource := range freed {
+		l.grantNextWriterLocked(resource)
+	}
+}
+
+// startLockMaintenance spins up the background reaper goroutine for
+// this lock server. It runs for the lifetime of the process.
+func (l *lockServer) startLockMaintenance() {
+	go func() {
+		ticker := time.NewTicker(lockMaintenanceInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			l.reapExpired()
+		}
+	}()
+}
+
+// ListLocksArgs carries the filters for a ListLocks query: Prefix
+// restricts the scan to resources with that prefix, Duration (if
+// non-zero) restricts it to locks held for at least that long, and
+// WriterOnly/Node further narrow the results. All filters are
+// optional; the zero value of each matches everything.
+type ListLocksArgs struct {
+	AuthRPCArgs
+
+	Prefix     string
+	Duration   time.Duration
+	WriterOnly bool
+	Node       string
+}
+
+// lockEntryInfo is the public snapshot of a single lockRequesterInfo,
+// returned by ListLocks for operator consumption.
+type lockEntryInfo struct {
+	Resource    string    // Resource (path) that is locked.
+	Writer      bool      // Whether this entry holds the write lock.
+	Node        string    // Network address of the lock holder.
+	RPCPath     string    // RPC path of the lock holder.
+	UID         string    // UID identifying the lock holder's request.
+	Since       time.Time // When the lock was acquired.
+	ReaderCount int       // Number of readers sharing this resource (1 for a writer).
+}
+
+// ListLocksReply is the response to a ListLocks call.
+type ListLocksReply struct {
+	Locks []lockEntryInfo
+}
+
+// ListLocks - rpc handler returning a filtered snapshot of lockMap,
+// for operators diagnosing stuck locks before resorting to
+// ForceUnlock.
+func (l *lockServer) ListLocks(args *ListLocksArgs, reply *ListLocksReply) error {
+	if err := args.IsAuthenticated(); err != nil {
+		return err
+	}
+	reply.Locks = l.listLocksMatching(args)
+	return nil
+}
+
+// listLocksMatching returns the locks matching args' filters without
+// performing an authentication check of its own. It is the shared
+// implementation behind the authenticated ListLocks RPC as well as the
+// admin ListLocks handler's same-process aggregation (listLocks, in
+// admin-handlers-locks.go): that handler has already authenticated the
+// incoming admin HTTP request, so re-checking an RPC auth token for an
+// in-process call would only reject every local lock server.
+func (l *lockServer) listLocksMatching(args *ListLocksArgs) []lockEntryInfo {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var locks []lockEntryInfo
+	now := UTCNow()
+	for resource, lri := range l.lockMap {
+		if args.Prefix != "" && !strings.HasPrefix(resource, args.Prefix) {
+			continue
+		}
+		writer := isWriteLock(lri)
+		if args.WriterOnly && !writer {
+			continue
+		}
+		for _, entry := range lri {
+			if args.Node != "" && entry.node != args.Node {
+				continue
+			}
+			if args.Duration > 0 && now.Sub(entry.timestamp) < args.Duration {
+				continue
+			}
+			locks = append(locks, lockEntryInfo{
+				Resource:    resource,
+				Writer:      entry.writer,
+				Node:        entry.node,
+				RPCPath:     entry.rpcPath,
+				UID:         entry.uid,
+				Since:       entry.timestamp,
+				ReaderCount: len(lri),
+			})
+		}
+	}
+	return locks
+}
+
+// globalLockServers holds every lockServer started on this node,
+// populated by newLockServers. The admin ListLocks handler consults
+// it to answer queries for the locks held locally without a network
+// round trip.
+var globalLockServers []*lockServer
+
+// globalSrvCmdConfig is the serverCmdConfig newLockServers was last
+// called with, kept around so the admin ListLocks handler can later
+// work out which remote nodes to query.
+var globalSrvCmdConfig serverCmdConfig
+
+// newLockServers returns a lock server per local disk endpoint found
+// in srvCmd, each keyed by that disk's rpc path. Distributed setups
+// run one lockServer per storage endpoint that is local to this node;
+// remote endpoints are served by the lockServer running on their own
+// node.
+func newLockServers(srvCmd serverCmdConfig) (lockServers []*lockServer) {
+	if !globalIsDistXL {
+		return nil
+	}
+	seenLocal := make(map[string]bool)
+	for _, ep := range srvCmd.endpoints {
+		if !isLocalStorage(ep) {
+			continue
+		}
+		if seenLocal[ep.String()] {
+			continue
+		}
+		seenLocal[ep.String()] = true
+		locker := &lockServer{
+			rpcPath:      ep.Path,
+			mutex:        sync.Mutex{},
+			lockMap:      make(map[string][]lockRequesterInfo),
+			writeWaiters: make(map[string][]*lockWaiter),
+		}
+		locker.startLockMaintenance()
+		lockServers = append(lockServers, locker)
+	}
+	globalLockServers = lockServers
+	globalSrvCmdConfig = srvCmd
+	return lockServers
+}
+
+// remoteLockRPCNodes returns the unique, non-local node addresses
+// found among srvCmd's endpoints - the peers the admin ListLocks
+// handler must query over RPC to assemble a cluster-wide view.
+func remoteLockRPCNodes(srvCmd serverCmdConfig) (nodes []string) {
+	seen := make(map[string]bool)
+	for _, ep := range srvCmd.endpoints {
+		if isLocalStorage(ep) || ep.Host == "" || seen[ep.Host] {
+			continue
+		}
+		seen[ep.Host] = true
+		nodes = append(nodes, ep.Host)
+	}
+	return nodes
+}
+
+// isLocalStorage reports whether the given endpoint refers to a
+// disk hosted on this node.
+func isLocalStorage(ep *url.URL) bool {
+	if ep.Host == "" {
+		return true
+	}
+	if globalMinioHost != "" {
+		return ep.Hostname() == globalMinioHost
+	}
+	return isLocalHost(ep.Hostname())
+}
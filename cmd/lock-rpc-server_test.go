@@ -55,6 +55,7 @@ func createLockTestServer(t *testing.T) (string, *lockServer, string) {
 		rpcPath:       "rpc-path",
 		mutex:         sync.Mutex{},
 		lockMap:       make(map[string][]lockRequesterInfo),
+		writeWaiters:  make(map[string][]*lockWaiter),
 	}
 	creds := serverConfig.GetCredential()
 	loginArgs := LoginRPCArgs{
@@ -83,7 +84,7 @@ func TestLockRpcServerLock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la.SetAuthToken(token)
 	la.SetRequestTime(time.Now().UTC())
 
@@ -117,7 +118,7 @@ func TestLockRpcServerLock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la2.SetAuthToken(token)
 	la2.SetRequestTime(time.Now().UTC())
 
@@ -141,7 +142,7 @@ func TestLockRpcServerUnlock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la.SetAuthToken(token)
 	la.SetRequestTime(time.Now().UTC())
 
@@ -189,7 +190,7 @@ func TestLockRpcServerRLock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la.SetAuthToken(token)
 	la.SetRequestTime(time.Now().UTC())
 
@@ -223,7 +224,7 @@ func TestLockRpcServerRLock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la2.SetAuthToken(token)
 	la2.SetRequestTime(time.Now().UTC())
 
@@ -247,7 +248,7 @@ func TestLockRpcServerRUnlock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la.SetAuthToken(token)
 	la.SetRequestTime(time.Now().UTC())
 
@@ -273,7 +274,7 @@ func TestLockRpcServerRUnlock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la2.SetAuthToken(token)
 	la2.SetRequestTime(time.Now().UTC())
 
@@ -338,7 +339,7 @@ func TestLockRpcServerForceUnlock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	laForce.SetAuthToken(token)
 	laForce.SetRequestTime(time.Now().UTC())
 
@@ -362,7 +363,7 @@ func TestLockRpcServerForceUnlock(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 0)
 	la.SetAuthToken(token)
 	la.SetRequestTime(time.Now().UTC())
 
@@ -398,8 +399,8 @@ func TestLockRpcServerForceUnlock(t *testing.T) {
 	}
 }
 
-// Test Expired functionality
-func TestLockRpcServerExpired(t *testing.T) {
+// Test Renew functionality
+func TestLockRpcServerRenew(t *testing.T) {
 	testPath, locker, token := createLockTestServer(t)
 	defer removeAll(testPath)
 
@@ -408,23 +409,18 @@ func TestLockRpcServerExpired(t *testing.T) {
 		Resource:        "name",
 		ServerAddr:      "node",
 		ServiceEndpoint: "rpc-path",
-	})
+	}, 50 * time.Millisecond)
 	la.SetAuthToken(token)
 	la.SetRequestTime(time.Now().UTC())
 
-	// Unknown lock at server will return expired = true
-	var expired bool
-	err := locker.Expired(&la, &expired)
-	if err != nil {
-		t.Errorf("Expected no error, got %#v", err)
-	} else {
-		if !expired {
-			t.Errorf("Expected %#v, got %#v", true, expired)
-		}
+	// Renew of a lock that was never granted fails.
+	var result bool
+	err := locker.Renew(&la, &result)
+	if err == nil {
+		t.Errorf("Expected error, got %#v", nil)
 	}
 
-	// Create lock (so that we can test that it is not expired)
-	var result bool
+	// Claim the lock.
 	la.SetRequestTime(time.Now().UTC())
 	err = locker.Lock(&la, &result)
 	if err != nil {
@@ -433,14 +429,154 @@ func TestLockRpcServerExpired(t *testing.T) {
 		t.Errorf("Expected %#v, got %#v", true, result)
 	}
 
+	// Renew succeeds while the lock is still held and pushes its
+	// deadline forward.
+	before := locker.lockMap["name"][0].expiresAt
+	time.Sleep(time.Millisecond)
 	la.SetRequestTime(time.Now().UTC())
-	err = locker.Expired(&la, &expired)
+	err = locker.Renew(&la, &result)
 	if err != nil {
-		t.Errorf("Expected no error, got %#v", err)
-	} else {
-		if expired {
-			t.Errorf("Expected %#v, got %#v", false, expired)
-		}
+		t.Errorf("Expected %#v, got %#v", nil, err)
+	} else if !result {
+		t.Errorf("Expected %#v, got %#v", true, result)
+	}
+	if !locker.lockMap["name"][0].expiresAt.After(before) {
+		t.Errorf("Expected Renew to push expiresAt forward")
+	}
+
+	// Renew by a uid that does not hold the lock fails.
+	laOther := newLockArgs(dsync.LockArgs{
+		UID:             "89ab-cdef",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	laOther.SetAuthToken(token)
+	laOther.SetRequestTime(time.Now().UTC())
+	err = locker.Renew(&laOther, &result)
+	if err == nil {
+		t.Errorf("Expected error, got %#v", nil)
+	}
+}
+
+// Test that a Renew call which omits a TTL of its own leaves the
+// lock's existing lease deadline untouched rather than clearing it -
+// clearing it would turn a renewal into an accidental unleasing that
+// the reaper would then never reclaim.
+func TestLockRpcServerRenewWithoutTTLKeepsExistingLease(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	la := newLockArgs(dsync.LockArgs{
+		UID:             "0123-4567",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 50 * time.Millisecond)
+	la.SetAuthToken(token)
+	la.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.Lock(&la, &result); err != nil || !result {
+		t.Fatalf("Expected write lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	before := locker.lockMap["name"][0].expiresAt
+	if before.IsZero() {
+		t.Fatalf("Expected the lock to carry a lease deadline after Lock with a TTL")
+	}
+
+	renew := newLockArgs(dsync.LockArgs{
+		UID:             "0123-4567",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	renew.SetAuthToken(token)
+	renew.SetRequestTime(time.Now().UTC())
+
+	if err := locker.Renew(&renew, &result); err != nil || !result {
+		t.Fatalf("Expected Renew to succeed, got err=%v result=%v", err, result)
+	}
+	if !locker.lockMap["name"][0].expiresAt.Equal(before) {
+		t.Errorf("Expected a TTL-less Renew to leave expiresAt unchanged, got %v want %v", locker.lockMap["name"][0].expiresAt, before)
+	}
+}
+
+// Test that a holder who stops renewing loses the lock once its
+// lease expires and the reaper sweeps it.
+func TestLockRpcServerRenewAfterExpiryFails(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	la := newLockArgs(dsync.LockArgs{
+		UID:             "0123-4567",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, time.Millisecond)
+	la.SetAuthToken(token)
+	la.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	err := locker.Lock(&la, &result)
+	if err != nil {
+		t.Errorf("Expected %#v, got %#v", nil, err)
+	} else if !result {
+		t.Errorf("Expected %#v, got %#v", true, result)
+	}
+
+	// Let the lease lapse and run the reaper manually (the background
+	// goroutine only fires on lockMaintenanceInterval).
+	time.Sleep(2 * time.Millisecond)
+	locker.reapExpired()
+
+	la.SetRequestTime(time.Now().UTC())
+	err = locker.Renew(&la, &result)
+	if err == nil {
+		t.Errorf("Expected error, got %#v", nil)
+	}
+}
+
+// Test that the reaper evicts only the entries past their deadline.
+func TestLockRpcServerReaperEviction(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	expiring := newLockArgs(dsync.LockArgs{
+		UID:             "0123-4567",
+		Resource:        "expiring",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, time.Millisecond)
+	expiring.SetAuthToken(token)
+	expiring.SetRequestTime(time.Now().UTC())
+
+	longLived := newLockArgs(dsync.LockArgs{
+		UID:             "89ab-cdef",
+		Resource:        "long-lived",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, time.Hour)
+	longLived.SetAuthToken(token)
+	longLived.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.Lock(&expiring, &result); err != nil || !result {
+		t.Fatalf("Expected lock to be granted, got err=%v result=%v", err, result)
+	}
+	if err := locker.Lock(&longLived, &result); err != nil || !result {
+		t.Fatalf("Expected lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	locker.reapExpired()
+
+	if _, ok := locker.lockMap["expiring"]; ok {
+		t.Errorf("Expected expired entry to be reaped")
+	}
+	if _, ok := locker.lockMap["long-lived"]; !ok {
+		t.Errorf("Expected long-lived entry to survive reaping")
 	}
 }
 
@@ -520,3 +656,409 @@ func TestLockServers(t *testing.T) {
 		}
 	}
 }
+
+// Test that a writer queued behind existing readers via LockBlocking
+// is eventually granted the lock once those readers release it.
+func TestLockRpcServerLockBlockingWriterWinsAfterReaders(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	reader := newLockArgs(dsync.LockArgs{
+		UID:             "reader-1",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	reader.SetAuthToken(token)
+	reader.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.RLock(&reader, &result); err != nil || !result {
+		t.Fatalf("Expected read lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	writer := newLockArgs(dsync.LockArgs{
+		UID:             "writer-1",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	writer.Deadline = time.Second
+	writer.SetAuthToken(token)
+	writer.SetRequestTime(time.Now().UTC())
+
+	granted := make(chan bool, 1)
+	go func() {
+		var writerResult bool
+		err := locker.LockBlocking(&writer, &writerResult)
+		if err != nil {
+			t.Errorf("Expected %#v, got %#v", nil, err)
+		}
+		granted <- writerResult
+	}()
+
+	// Give the writer a chance to enqueue before releasing the reader.
+	for i := 0; i < 100 && len(locker.writeWaiters["name"]) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if len(locker.writeWaiters["name"]) != 1 {
+		t.Fatalf("Expected writer to be queued, got %d waiters", len(locker.writeWaiters["name"]))
+	}
+
+	reader.SetRequestTime(time.Now().UTC())
+	if err := locker.RUnlock(&reader, &result); err != nil || !result {
+		t.Fatalf("Expected read unlock to succeed, got err=%v result=%v", err, result)
+	}
+
+	select {
+	case writerResult := <-granted:
+		if !writerResult {
+			t.Errorf("Expected queued writer to be granted the lock")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for queued writer to be granted the lock")
+	}
+}
+
+// Test that readers arriving after a writer is queued are deferred
+// rather than being granted ahead of it.
+func TestLockRpcServerRLockDeferredBehindQueuedWriter(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	first := newLockArgs(dsync.LockArgs{
+		UID:             "writer-1",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	first.SetAuthToken(token)
+	first.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.Lock(&first, &result); err != nil || !result {
+		t.Fatalf("Expected write lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	queuedWriter := newLockArgs(dsync.LockArgs{
+		UID:             "writer-2",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	queuedWriter.Deadline = time.Second
+	queuedWriter.SetAuthToken(token)
+	queuedWriter.SetRequestTime(time.Now().UTC())
+
+	go func() {
+		var writerResult bool
+		locker.LockBlocking(&queuedWriter, &writerResult)
+	}()
+
+	for i := 0; i < 100 && len(locker.writeWaiters["name"]) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if len(locker.writeWaiters["name"]) != 1 {
+		t.Fatalf("Expected writer to be queued, got %d waiters", len(locker.writeWaiters["name"]))
+	}
+
+	reader := newLockArgs(dsync.LockArgs{
+		UID:             "reader-1",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	reader.SetAuthToken(token)
+	reader.SetRequestTime(time.Now().UTC())
+
+	err := locker.RLock(&reader, &result)
+	if err != nil {
+		t.Errorf("Expected %#v, got %#v", nil, err)
+	} else if result {
+		t.Errorf("Expected reader to be deferred behind queued writer, got granted")
+	}
+}
+
+// Test that CancelWait drops a queued waiter without granting it the
+// lock, freeing its slot for callers that timed out locally.
+func TestLockRpcServerCancelWait(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	holder := newLockArgs(dsync.LockArgs{
+		UID:             "writer-1",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	holder.SetAuthToken(token)
+	holder.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.Lock(&holder, &result); err != nil || !result {
+		t.Fatalf("Expected write lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	waiting := newLockArgs(dsync.LockArgs{
+		UID:             "writer-2",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	waiting.Deadline = time.Hour
+	waiting.SetAuthToken(token)
+	waiting.SetRequestTime(time.Now().UTC())
+
+	go func() {
+		var waitingResult bool
+		locker.LockBlocking(&waiting, &waitingResult)
+	}()
+
+	for i := 0; i < 100 && len(locker.writeWaiters["name"]) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiting.SetRequestTime(time.Now().UTC())
+	var cancelled bool
+	if err := locker.CancelWait(&waiting, &cancelled); err != nil {
+		t.Errorf("Expected %#v, got %#v", nil, err)
+	} else if !cancelled {
+		t.Errorf("Expected CancelWait to find and remove the queued waiter")
+	}
+
+	if len(locker.writeWaiters["name"]) != 0 {
+		t.Errorf("Expected waiter queue for resource to be empty after cancellation")
+	}
+
+	// Releasing the original holder must not grant the cancelled
+	// waiter the lock.
+	holder.SetRequestTime(time.Now().UTC())
+	if err := locker.Unlock(&holder, &result); err != nil || !result {
+		t.Fatalf("Expected write unlock to succeed, got err=%v result=%v", err, result)
+	}
+	if _, ok := locker.lockMap["name"]; ok {
+		t.Errorf("Expected resource to remain free after cancelled waiter's slot was dropped")
+	}
+}
+
+// Test that a waiter cancelled via CancelWait still gets a prompt
+// false reply from LockBlocking once its own Deadline elapses,
+// instead of the RPC handler goroutine blocking forever on a
+// waiter.granted channel that CancelWait never closes.
+func TestLockRpcServerLockBlockingReturnsAfterCancelWait(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	holder := newLockArgs(dsync.LockArgs{
+		UID:             "writer-1",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	holder.SetAuthToken(token)
+	holder.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.Lock(&holder, &result); err != nil || !result {
+		t.Fatalf("Expected write lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	waiting := newLockArgs(dsync.LockArgs{
+		UID:             "writer-2",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	waiting.Deadline = 20 * time.Millisecond
+	waiting.SetAuthToken(token)
+	waiting.SetRequestTime(time.Now().UTC())
+
+	done := make(chan bool, 1)
+	go func() {
+		var waitingResult bool
+		locker.LockBlocking(&waiting, &waitingResult)
+		done <- waitingResult
+	}()
+
+	for i := 0; i < 100 && len(locker.writeWaiters["name"]) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiting.SetRequestTime(time.Now().UTC())
+	var cancelled bool
+	if err := locker.CancelWait(&waiting, &cancelled); err != nil || !cancelled {
+		t.Fatalf("Expected CancelWait to find and remove the queued waiter, got err=%v cancelled=%v", err, cancelled)
+	}
+
+	select {
+	case waitingResult := <-done:
+		if waitingResult {
+			t.Errorf("Expected LockBlocking to report failure for a cancelled waiter")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected LockBlocking to return once its Deadline elapsed, but it never did")
+	}
+}
+
+// Test ListLocks filtering by prefix, age and writer-only.
+func TestLockRpcServerListLocks(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	writerArgs := newLockArgs(dsync.LockArgs{
+		UID:             "writer-1",
+		Resource:        "bucket/object-a",
+		ServerAddr:      "node-1",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	writerArgs.SetAuthToken(token)
+	writerArgs.SetRequestTime(time.Now().UTC())
+
+	readerArgs1 := newLockArgs(dsync.LockArgs{
+		UID:             "reader-1",
+		Resource:        "other/object-b",
+		ServerAddr:      "node-2",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	readerArgs1.SetAuthToken(token)
+	readerArgs1.SetRequestTime(time.Now().UTC())
+
+	readerArgs2 := newLockArgs(dsync.LockArgs{
+		UID:             "reader-2",
+		Resource:        "other/object-b",
+		ServerAddr:      "node-2",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	readerArgs2.SetAuthToken(token)
+	readerArgs2.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.Lock(&writerArgs, &result); err != nil || !result {
+		t.Fatalf("Expected write lock to be granted, got err=%v result=%v", err, result)
+	}
+	if err := locker.RLock(&readerArgs1, &result); err != nil || !result {
+		t.Fatalf("Expected read lock to be granted, got err=%v result=%v", err, result)
+	}
+	if err := locker.RLock(&readerArgs2, &result); err != nil || !result {
+		t.Fatalf("Expected read lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	// No filter: every entry across both resources is returned, and
+	// the shared resource reports its reader count correctly.
+	var reply ListLocksReply
+	listArgs := ListLocksArgs{}
+	listArgs.SetAuthToken(token)
+	listArgs.SetRequestTime(time.Now().UTC())
+	if err := locker.ListLocks(&listArgs, &reply); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(reply.Locks) != 3 {
+		t.Fatalf("Expected 3 lock entries, got %d", len(reply.Locks))
+	}
+	for _, entry := range reply.Locks {
+		if entry.Resource == "other/object-b" && entry.ReaderCount != 2 {
+			t.Errorf("Expected reader count 2 for shared resource, got %d", entry.ReaderCount)
+		}
+	}
+
+	// Prefix filter restricts results to the matching resource.
+	reply = ListLocksReply{}
+	prefixArgs := ListLocksArgs{Prefix: "bucket/"}
+	prefixArgs.SetAuthToken(token)
+	prefixArgs.SetRequestTime(time.Now().UTC())
+	if err := locker.ListLocks(&prefixArgs, &reply); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(reply.Locks) != 1 || reply.Locks[0].Resource != "bucket/object-a" {
+		t.Errorf("Expected a single entry for bucket/object-a, got %#v", reply.Locks)
+	}
+
+	// WriterOnly filter excludes the shared read lock.
+	reply = ListLocksReply{}
+	writerOnlyArgs := ListLocksArgs{WriterOnly: true}
+	writerOnlyArgs.SetAuthToken(token)
+	writerOnlyArgs.SetRequestTime(time.Now().UTC())
+	if err := locker.ListLocks(&writerOnlyArgs, &reply); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(reply.Locks) != 1 || !reply.Locks[0].Writer {
+		t.Errorf("Expected a single writer entry, got %#v", reply.Locks)
+	}
+
+	// Age filter excludes locks younger than the threshold.
+	reply = ListLocksReply{}
+	ageArgs := ListLocksArgs{Duration: time.Hour}
+	ageArgs.SetAuthToken(token)
+	ageArgs.SetRequestTime(time.Now().UTC())
+	if err := locker.ListLocks(&ageArgs, &reply); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(reply.Locks) != 0 {
+		t.Errorf("Expected no entries older than an hour, got %#v", reply.Locks)
+	}
+}
+
+// Test that listLocks aggregates a node's local lock servers, the
+// same way ListLocksHandler calls it: with a bare ListLocksArgs that
+// carries no RPC auth token. If listLocks went through the
+// authenticated ListLocks RPC for local servers instead of
+// listLocksMatching, this would find zero locks.
+func TestListLocksAggregatesLocalServers(t *testing.T) {
+	testPath, locker, token := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	currentGlobalLockServers := globalLockServers
+	globalLockServers = []*lockServer{locker}
+	defer func() { globalLockServers = currentGlobalLockServers }()
+
+	la := newLockArgs(dsync.LockArgs{
+		UID:             "0123-4567",
+		Resource:        "name",
+		ServerAddr:      "node",
+		ServiceEndpoint: "rpc-path",
+	}, 0)
+	la.SetAuthToken(token)
+	la.SetRequestTime(time.Now().UTC())
+
+	var result bool
+	if err := locker.Lock(&la, &result); err != nil || !result {
+		t.Fatalf("Expected write lock to be granted, got err=%v result=%v", err, result)
+	}
+
+	locks := listLocks(nil, ListLocksArgs{})
+	if len(locks) != 1 || locks[0].Resource != "name" {
+		t.Errorf("Expected the local server's lock to be aggregated, got %#v", locks)
+	}
+}
+
+// Test that cancelWaiterLocked no longer finds a waiter that
+// grantNextWriterLocked already granted - the signal LockBlocking's
+// timeout branch relies on to tell a last-instant grant apart from an
+// actual timeout, and to honor the grant instead of leaking the lock.
+func TestLockRpcServerCancelWaiterLockedAfterGrant(t *testing.T) {
+	testPath, locker, _ := createLockTestServer(t)
+	defer removeAll(testPath)
+
+	waiter := &lockWaiter{
+		uid:     "writer-1",
+		node:    "node",
+		rpcPath: "rpc-path",
+		granted: make(chan struct{}),
+	}
+	locker.writeWaiters["name"] = []*lockWaiter{waiter}
+
+	locker.grantNextWriterLocked("name")
+
+	select {
+	case <-waiter.granted:
+	default:
+		t.Fatalf("Expected grantNextWriterLocked to close the waiter's granted channel")
+	}
+	if _, ok := locker.lockMap["name"]; !ok {
+		t.Errorf("Expected the granted waiter's lock to be present in lockMap")
+	}
+
+	if locker.cancelWaiterLocked("name", "writer-1") {
+		t.Errorf("Expected cancelWaiterLocked to find nothing once the waiter was already granted")
+	}
+}